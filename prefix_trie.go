@@ -1,32 +1,122 @@
 // Package prefixtrie provides a prefix trie data structure for building
 // efficient indices of substring-searchable string data.
 //
-// The provided implementation only supports storing ints, which should be
-// sufficient for most searches over slices (e.g. find elements with name
-// matching a substring) and word searches for documents (the end of the word
-// can be scanned from the beginning of the word).
+// The trie is generic over the stored value type, so it can be used to index
+// anything from plain ints to struct pointers, the same way go-patricia
+// stores arbitrary Item values or Docker's TruncIndex stores string IDs
+// directly.
 package prefixtrie
 
 import (
-	"strings"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"unicode/utf8"
 )
 
+// SkipSubtree can be returned from a Walk or VisitSubtree visitor to skip the
+// remaining values nested under the key just visited, without stopping the
+// walk elsewhere.
+var SkipSubtree = errors.New("prefixtrie: skip subtree")
+
+// StopWalk can be returned from a Walk or VisitSubtree visitor to stop the
+// walk immediately. Walk and VisitSubtree return nil when the visitor stops
+// the walk this way.
+var StopWalk = errors.New("prefixtrie: stop walk")
+
+// ErrPrefixNotFound is returned by Lookup when no key starts with the given
+// prefix.
+var ErrPrefixNotFound = errors.New("prefixtrie: prefix not found")
+
+// ErrAmbiguousPrefix is returned by Lookup when more than one key starts
+// with the given prefix.
+type ErrAmbiguousPrefix struct {
+	Prefix string
+}
+
+func (e ErrAmbiguousPrefix) Error() string {
+	return fmt.Sprintf("prefixtrie: prefix %q matches more than one key", e.Prefix)
+}
+
+// MaxChildrenPerSparseNode is the number of children a node holds in its
+// sorted-slice ("sparse") representation before it is migrated to the
+// byte/rune-indexed ("dense") representation. Nodes that fan out widely,
+// such as the root of a trie indexing hex-like or URL keys, benefit from the
+// switch since dense dispatch is O(1) regardless of fan-out, whereas sparse
+// dispatch is O(log n).
+//
+// This is a var rather than a const so callers can tune the trade-off
+// between memory (dense nodes always reserve a 256-entry table) and lookup
+// speed for their key distribution.
+var MaxChildrenPerSparseNode = 8
+
 // Trie is a prefix trie where you can add values and find values.
 //
 // A zero value Trie is ready to use.
 //
-// Parallel reads (Find) are safe but writes (Add) in parallel with reads or
-// other writes are undefined behavior.
-type Trie struct {
-	root node
+// Add and Delete build a new tree rather than mutating the existing one in
+// place, then atomically publish it as t's root, so Find and the other
+// read methods are safe to call concurrently with them, and any Snapshot or
+// Txn taken before an Add or Delete keeps seeing the tree as it was. Add and
+// Delete are not safe to call concurrently with each other, since they race
+// on which one's new tree is published last.
+//
+// For the pre-generics int-valued behavior, instantiate as Trie[int].
+type Trie[V any] struct {
+	root atomic.Pointer[node[V]]
+
+	// GlobSeparator is the segment separator FindGlob uses to distinguish
+	// '*' (matches within one segment) from '**' (matches across segments).
+	// The zero byte (the default) disables segmentation, so '*' and '**'
+	// both match any run of runes.
+	GlobSeparator byte
+}
+
+// IntTrie is a thin alias for Trie[int], the int-valued trie the package
+// provided before it was made generic. The bare name Trie now names the
+// generic type above, so code written against the non-generic Trie compiles
+// against IntTrie only once its type name is changed to IntTrie.
+type IntTrie = Trie[int]
+
+// currentRoot returns t's root node, or an empty node if Add hasn't run yet.
+func (t *Trie[V]) currentRoot() *node[V] {
+	if r := t.root.Load(); r != nil {
+		return r
+	}
+	return &node[V]{}
 }
 
 // Add adds a value to the Trie by a key.
-func (t *Trie) Add(key string, value int) {
+func (t *Trie[V]) Add(key string, value V) {
+	root := t.currentRoot()
 	for i := range key {
-		t.root.add(key[i:], value)
+		root = root.add(key[i:], leaf[V]{key: key, value: value, head: i == 0})
 	}
+	t.root.Store(root)
+}
+
+// Delete removes every value that was added under key, across all the
+// suffix positions Add stored it at, compacting any subtree that becomes
+// empty or mergeable as a result.
+//
+// It reports whether key was present.
+func (t *Trie[V]) Delete(key string) bool {
+	root := t.root.Load()
+	if root == nil {
+		return false
+	}
+	removedAny := false
+	for i := range key {
+		if newRoot, removed := root.delete(key[i:], key); removed {
+			root, removedAny = newRoot, true
+		}
+	}
+	if removedAny {
+		t.root.Store(root)
+	}
+	return removedAny
 }
 
 // Find finds the values that were added with a key that is a substring match
@@ -35,50 +125,605 @@ func (t *Trie) Add(key string, value int) {
 // The found values are appended to the dst slice and the resulting slice is
 // returned. Passing nil as dst will return the values in a newly allocated
 // slice. If no matching values are found, dst will be returned as is.
-func (t *Trie) Find(dst []int, prefix string) []int {
-	return t.root.find(dst, prefix)
+func (t *Trie[V]) Find(dst []V, prefix string) []V {
+	return t.Snapshot().Find(dst, prefix)
+}
+
+// FindGlob finds the values whose indexed key (Add indexes every suffix of
+// the key it is given, which is also what makes Find a substring match)
+// matches the glob pattern in full, the same way filepath.Match
+// matches a whole name rather than a prefix of it. Use a trailing '*' or '**'
+// to match an open-ended suffix.
+//
+// pattern supports '?' to match exactly one rune, '*' to match a run of zero
+// or more runes within a single segment, and '**' to match a run of zero or
+// more runes across segments. Segments are delimited by t.GlobSeparator; see
+// its doc comment for the unsegmented default.
+//
+// The found values are appended to dst and the resulting slice is returned,
+// the same convention Find uses.
+func (t *Trie[V]) FindGlob(dst []V, pattern string) []V {
+	return t.Snapshot().FindGlob(dst, pattern)
+}
+
+// Walk calls visit for every value whose key is a substring match of prefix,
+// passing the concatenated key that produced it, in the same order Find
+// would return the values.
+//
+// Returning SkipSubtree from visit skips the remaining values nested under
+// the key just visited but continues the walk elsewhere. Returning StopWalk
+// stops the walk immediately; Walk returns nil in that case. Any other
+// non-nil error stops the walk and is returned from Walk as-is.
+func (t *Trie[V]) Walk(prefix string, visit func(key string, value V) error) error {
+	return t.Snapshot().Walk(prefix, visit)
+}
+
+// VisitSubtree is Walk under the name used by go-patricia's VisitSubtree, for
+// callers porting code from it.
+func (t *Trie[V]) VisitSubtree(prefix string, visit func(key string, value V) error) error {
+	return t.Walk(prefix, visit)
+}
+
+// Lookup returns the single value whose original key starts with prefix,
+// the TruncIndex-style shortened-ID resolution Docker and git use for
+// object/container IDs.
+//
+// Unlike Find, which also matches prefix against values inserted from
+// mid-string suffixes, Lookup only considers true prefixes of an original
+// key. It returns ErrPrefixNotFound if no key starts with prefix, and
+// ErrAmbiguousPrefix if more than one does.
+func (t *Trie[V]) Lookup(prefix string) (V, error) {
+	return t.Snapshot().Lookup(prefix)
+}
+
+// Snapshot returns an immutable, point-in-time view of t's contents. It
+// remains valid and unchanged regardless of later Add/Delete calls on t or
+// Txns committed against t: those build a new tree rather than mutating the
+// one a Snapshot holds onto.
+//
+// A Snapshot is safe for concurrent use, including concurrently with writes.
+func (t *Trie[V]) Snapshot() *Snapshot[V] {
+	return &Snapshot[V]{root: t.root.Load(), globSeparator: t.GlobSeparator}
+}
+
+// Snapshot is an immutable view of a Trie's contents, as returned by
+// Trie.Snapshot or Txn.Snapshot.
+type Snapshot[V any] struct {
+	root          *node[V]
+	globSeparator byte
+}
+
+// Find is Trie.Find, evaluated against the Snapshot's point-in-time tree.
+func (s *Snapshot[V]) Find(dst []V, prefix string) []V {
+	if s.root == nil {
+		return dst
+	}
+	return s.root.find(dst, prefix)
+}
+
+// FindGlob is Trie.FindGlob, evaluated against the Snapshot's point-in-time
+// tree.
+func (s *Snapshot[V]) FindGlob(dst []V, pattern string) []V {
+	if s.root == nil {
+		return dst
+	}
+	prog := compileGlobPattern(pattern)
+	states := make([]bool, len(prog.ops)+1)
+	states[0] = true
+	epsilonCloseGlob(states, prog.epsilonClosure)
+	pool := globStatePoolPool.Get().(*globStatePool)
+	defer globStatePoolPool.Put(pool)
+	return s.root.findGlob(dst, states, prog, rune(s.globSeparator), s.globSeparator != 0, pool, 0)
+}
+
+// Walk is Trie.Walk, evaluated against the Snapshot's point-in-time tree.
+func (s *Snapshot[V]) Walk(prefix string, visit func(key string, value V) error) error {
+	if s.root == nil {
+		return nil
+	}
+	err := s.root.walk("", prefix, visit)
+	if err == StopWalk {
+		return nil
+	}
+	return err
+}
+
+// VisitSubtree is Walk under the name used by go-patricia's VisitSubtree, for
+// callers porting code from it.
+func (s *Snapshot[V]) VisitSubtree(prefix string, visit func(key string, value V) error) error {
+	return s.Walk(prefix, visit)
+}
+
+// Lookup is Trie.Lookup, evaluated against the Snapshot's point-in-time tree.
+func (s *Snapshot[V]) Lookup(prefix string) (V, error) {
+	var zero V
+	if s.root == nil {
+		return zero, ErrPrefixNotFound
+	}
+	n, ok := s.root.locate(prefix)
+	if !ok {
+		return zero, ErrPrefixNotFound
+	}
+	result, found := zero, false
+	err := n.visitHeadValues(func(value V) error {
+		if found {
+			return ErrAmbiguousPrefix{Prefix: prefix}
+		}
+		result, found = value, true
+		return nil
+	})
+	if err != nil {
+		return zero, err
+	}
+	if !found {
+		return zero, ErrPrefixNotFound
+	}
+	return result, nil
+}
+
+// Txn starts a copy-on-write transaction against t. Writes made through the
+// returned Txn are invisible to t and to Snapshots taken before Commit;
+// Commit atomically publishes them as t's new root.
+//
+// A Txn is not safe for concurrent use.
+func (t *Trie[V]) Txn() *Txn[V] {
+	return &Txn[V]{trie: t, root: t.currentRoot()}
+}
+
+// Txn accumulates Add and Delete calls on a copy-on-write path rooted at the
+// Trie's root as of when the Txn was created, analogous to hashicorp/go-memdb's
+// write transactions. Each write clones the nodes it descends through,
+// leaving subtrees it doesn't touch shared with the Trie's current root and
+// with any Snapshot taken before Commit.
+type Txn[V any] struct {
+	trie *Trie[V]
+	root *node[V]
+}
+
+// Add is Trie.Add, applied to the Txn's working tree.
+func (x *Txn[V]) Add(key string, value V) {
+	for i := range key {
+		x.root = x.root.add(key[i:], leaf[V]{key: key, value: value, head: i == 0})
+	}
+}
+
+// Delete is Trie.Delete, applied to the Txn's working tree.
+func (x *Txn[V]) Delete(key string) bool {
+	removedAny := false
+	for i := range key {
+		if newRoot, removed := x.root.delete(key[i:], key); removed {
+			x.root = newRoot
+			removedAny = true
+		}
+	}
+	return removedAny
+}
+
+// Snapshot returns an immutable view of the Txn's working tree, including
+// any writes made on it so far.
+func (x *Txn[V]) Snapshot() *Snapshot[V] {
+	return &Snapshot[V]{root: x.root, globSeparator: x.trie.GlobSeparator}
+}
+
+// Commit publishes the Txn's working tree as the Trie's new root. Snapshots
+// taken before Commit keep seeing the tree as it was; new calls to
+// t.Snapshot (and Find, Walk, Lookup, ...) see the Txn's writes.
+func (x *Txn[V]) Commit() {
+	x.trie.root.Store(x.root)
 }
 
-type node struct {
+type node[V any] struct {
 	prefix   string
-	values   []int
-	children []node
+	entries  []leaf[V]
+	children []node[V] // sparse representation, sorted by ascending first rune; unused once dense is non-nil
+	dense    *denseChildren[V]
 }
 
-func (n *node) add(key string, value int) {
-	commonPrefix := n.commonPrefix(n.prefix, key)
-	if len(commonPrefix) < len(n.prefix) {
-		n.split(commonPrefix)
+// leaf is a single value stored at a node, tagged with enough information to
+// answer Lookup (head) and Delete (key) without conflating values that
+// happen to share a suffix but came from different Add calls.
+type leaf[V any] struct {
+	key   string // the original key passed to Add
+	value V
+	head  bool // true if this entry was inserted at suffix offset 0 of key
+}
+
+// denseChildren is the dense, O(1)-dispatch representation a node migrates
+// to once its sparse child slice grows past MaxChildrenPerSparseNode. ASCII
+// (and other single-rune-value-below-256, e.g. Latin-1) first runes are
+// dispatched through the ascii array; everything else falls back to extra.
+type denseChildren[V any] struct {
+	ascii [256]*node[V]
+	extra map[rune]*node[V]
+}
+
+func (d *denseChildren[V]) get(r rune) *node[V] {
+	if r >= 0 && r < 256 {
+		return d.ascii[r]
 	}
-	if len(commonPrefix) == len(key) {
-		n.values = append(n.values, value)
+	if d.extra == nil {
+		return nil
+	}
+	return d.extra[r]
+}
+
+func (d *denseChildren[V]) set(r rune, c *node[V]) {
+	if r >= 0 && r < 256 {
+		d.ascii[r] = c
 		return
 	}
-	// sorted add (ascending rune value)
-	subKey := key[len(commonPrefix):]
-	firstRune := n.firstRune(subKey)
+	if d.extra == nil {
+		d.extra = make(map[rune]*node[V])
+	}
+	d.extra[r] = c
+}
+
+func (d *denseChildren[V]) delete(r rune) {
+	if r >= 0 && r < 256 {
+		d.ascii[r] = nil
+		return
+	}
+	delete(d.extra, r)
+}
+
+// empty reports whether d no longer holds any children.
+func (d *denseChildren[V]) empty() bool {
+	for _, c := range d.ascii {
+		if c != nil {
+			return false
+		}
+	}
+	return len(d.extra) == 0
+}
+
+func (d *denseChildren[V]) collectValues(dst []V) []V {
+	for _, c := range d.ascii {
+		if c != nil {
+			dst = c.collectValues(dst)
+		}
+	}
+	if len(d.extra) == 0 {
+		return dst
+	}
+	// extra only ever holds runes >= 256, so it sorts after the ascii range.
+	runes := make([]rune, 0, len(d.extra))
+	for r := range d.extra {
+		runes = append(runes, r)
+	}
+	sort.Slice(runes, func(i, j int) bool { return runes[i] < runes[j] })
+	for _, r := range runes {
+		dst = d.extra[r].collectValues(dst)
+	}
+	return dst
+}
+
+// newLeafNode builds a new node holding a single entry for subKey.
+func newLeafNode[V any](subKey string, e leaf[V]) node[V] {
+	return node[V]{prefix: subKey, entries: []leaf[V]{e}}
+}
+
+// promoteToDenseIfNeeded migrates n from the sparse to the dense
+// representation once its child count exceeds MaxChildrenPerSparseNode.
+func (n *node[V]) promoteToDenseIfNeeded() {
+	if len(n.children) <= MaxChildrenPerSparseNode {
+		return
+	}
+	dense := &denseChildren[V]{}
 	for i := range n.children {
-		c := &n.children[i]
-		if firstRuneOfChild := n.firstRune(c.prefix); firstRuneOfChild == firstRune {
-			c.add(subKey, value)
-			return
+		c := n.children[i]
+		dense.set(n.firstRune(c.prefix), &c)
+	}
+	n.dense = dense
+	n.children = nil
+}
+
+// add returns a new node with e added under key, cloning only the nodes on
+// the path down to e and sharing every untouched subtree with n, so that n
+// itself (and anything holding onto it, such as a Snapshot) is unaffected.
+func (n *node[V]) add(key string, e leaf[V]) *node[V] {
+	clone := *n
+	commonPrefix := clone.commonPrefix(clone.prefix, key)
+	if len(commonPrefix) < len(clone.prefix) {
+		clone.split(commonPrefix)
+	}
+	if len(commonPrefix) == len(key) {
+		clone.entries = append(append([]leaf[V](nil), clone.entries...), e)
+		return &clone
+	}
+	subKey := key[len(commonPrefix):]
+	if clone.dense != nil {
+		clone.addDense(subKey, e)
+		return &clone
+	}
+	firstRune := clone.firstRune(subKey)
+	for i := range clone.children {
+		c := &clone.children[i]
+		if firstRuneOfChild := clone.firstRune(c.prefix); firstRuneOfChild == firstRune {
+			children := append([]node[V](nil), clone.children...)
+			children[i] = *c.add(subKey, e)
+			clone.children = children
+			return &clone
 		} else if firstRuneOfChild > firstRune {
-			n.insertChildAtIndex(node{prefix: subKey, values: []int{value}}, i)
-			return
+			children := make([]node[V], 0, len(clone.children)+1)
+			children = append(children, clone.children[:i]...)
+			children = append(children, newLeafNode(subKey, e))
+			children = append(children, clone.children[i:]...)
+			clone.children = children
+			clone.promoteToDenseIfNeeded()
+			return &clone
+		}
+	}
+	clone.children = append(append([]node[V](nil), clone.children...), newLeafNode(subKey, e))
+	clone.promoteToDenseIfNeeded()
+	return &clone
+}
+
+// addDense is add for a node already in the dense representation.
+func (n *node[V]) addDense(key string, e leaf[V]) {
+	firstRune := n.firstRune(key)
+	dense := &denseChildren[V]{ascii: n.dense.ascii}
+	if n.dense.extra != nil {
+		dense.extra = make(map[rune]*node[V], len(n.dense.extra))
+		for r, c := range n.dense.extra {
+			dense.extra[r] = c
+		}
+	}
+	if c := n.dense.get(firstRune); c != nil {
+		dense.set(firstRune, c.add(key, e))
+	} else {
+		c := newLeafNode(key, e)
+		dense.set(firstRune, &c)
+	}
+	n.dense = dense
+}
+
+// globOpKind identifies what a single compiled glob op matches.
+type globOpKind byte
+
+const (
+	globLiteral           globOpKind = iota // a specific rune
+	globAnyRune                             // '?'
+	globAnySegment                          // '*'
+	globAnyAcrossSegments                   // '**'
+)
+
+type globOp struct {
+	kind globOpKind
+	r    rune // valid when kind == globLiteral
+}
+
+// globProgram is a compiled glob pattern: a flat program of literal rune and
+// wildcard ops, consumed left to right by findGlob's NFA simulation, plus
+// the epsilon closure of each position in that program.
+type globProgram struct {
+	ops []globOp
+
+	// epsilonClosure[pc] lists every position beyond pc reachable by
+	// skipping zero or more consecutive '*'/'**' ops without consuming a
+	// rune, i.e. the positions activating pc must also activate. It's
+	// precomputed once per pattern (the graph it describes is static) so
+	// stepGlob can extend a newly active position with a slice lookup
+	// instead of rescanning the whole program on every rune.
+	epsilonClosure [][]int
+}
+
+// compileGlobPattern parses pattern into a globProgram.
+func compileGlobPattern(pattern string) *globProgram {
+	runes := []rune(pattern)
+	ops := make([]globOp, 0, len(runes))
+	for i := 0; i < len(runes); i++ {
+		switch runes[i] {
+		case '?':
+			ops = append(ops, globOp{kind: globAnyRune})
+		case '*':
+			if i+1 < len(runes) && runes[i+1] == '*' {
+				ops = append(ops, globOp{kind: globAnyAcrossSegments})
+				i++
+			} else {
+				ops = append(ops, globOp{kind: globAnySegment})
+			}
+		default:
+			ops = append(ops, globOp{kind: globLiteral, r: runes[i]})
+		}
+	}
+	return &globProgram{ops: ops, epsilonClosure: computeEpsilonClosure(ops)}
+}
+
+// computeEpsilonClosure computes, for every position in ops, the positions
+// reachable from it by skipping zero or more consecutive '*'/'**' ops.
+func computeEpsilonClosure(ops []globOp) [][]int {
+	closure := make([][]int, len(ops)+1)
+	for start := range closure {
+		var reachable []int
+		for pc := start; pc < len(ops); pc++ {
+			kind := ops[pc].kind
+			if kind != globAnySegment && kind != globAnyAcrossSegments {
+				break
+			}
+			reachable = append(reachable, pc+1)
+		}
+		closure[start] = reachable
+	}
+	return closure
+}
+
+// epsilonCloseGlob extends states with the positions each active position in
+// it can reach without consuming a rune (see globProgram.epsilonClosure).
+func epsilonCloseGlob(states []bool, closure [][]int) {
+	for pc, active := range states {
+		if !active {
+			continue
+		}
+		for _, reachable := range closure[pc] {
+			states[reachable] = true
+		}
+	}
+}
+
+// stepGlob advances the NFA state set states by one rune r into next, which
+// must be len(states) long and zeroed, and reports whether any state is
+// active afterwards. separator and segmented configure how '*' treats r:
+// segmented '*' cannot consume the separator rune, while '**' always can.
+//
+// Rather than computing the raw transition and then re-running
+// epsilonCloseGlob's full scan of states over it, each position activated
+// here is epsilon-closed directly via prog.epsilonClosure, since that's
+// always just the handful of positions reachable from it.
+func stepGlob(next, states []bool, prog *globProgram, r, separator rune, segmented bool) bool {
+	ops := prog.ops
+	any := false
+	for pc, active := range states {
+		if !active || pc >= len(ops) {
+			continue
+		}
+		switch op := ops[pc]; op.kind {
+		case globLiteral:
+			if op.r == r {
+				any = activateGlobState(next, prog, pc+1) || any
+			}
+		case globAnyRune:
+			any = activateGlobState(next, prog, pc+1) || any
+		case globAnySegment:
+			if !segmented || r != separator {
+				any = activateGlobState(next, prog, pc) || any
+			}
+		case globAnyAcrossSegments:
+			any = activateGlobState(next, prog, pc) || any
+		}
+	}
+	return any
+}
+
+// activateGlobState sets next[pc] and every position pc's epsilon closure
+// reaches, reporting whether it changed anything.
+func activateGlobState(next []bool, prog *globProgram, pc int) bool {
+	changed := false
+	if !next[pc] {
+		next[pc] = true
+		changed = true
+	}
+	for _, reachable := range prog.epsilonClosure[pc] {
+		if !next[reachable] {
+			next[reachable] = true
+			changed = true
 		}
 	}
-	n.children = append(n.children, node{prefix: subKey, values: []int{value}})
+	return changed
+}
+
+// globStatePoolPool lets successive FindGlob calls reuse a globStatePool
+// (and the depth-indexed buffers it's already grown) instead of starting
+// over from empty each time, since the pool itself carries no state that's
+// specific to one call's pattern or tree.
+var globStatePoolPool = sync.Pool{New: func() any { return &globStatePool{} }}
+
+// globStatePool hands findGlob's DFS the pair of []bool state-set buffers it
+// ping-pongs between while consuming a node's prefix, indexed by the node's
+// depth in the trie. Since the DFS is sequential, only one node at a given
+// depth is ever being processed at a time, so the buffers for that depth can
+// simply be reused by whichever node reaches it next, with no allocation
+// once the pool has grown to the deepest path visited.
+type globStatePool struct {
+	pairs [][2][]bool
+}
+
+// buffers returns the pair of width-long scratch buffers for depth, growing
+// the pool if depth hasn't been reached before. Callers must clear a buffer
+// themselves before writing into it, since a reused buffer still holds
+// whatever the last node at this depth left behind.
+func (p *globStatePool) buffers(depth, width int) (a, b []bool) {
+	for len(p.pairs) <= depth {
+		p.pairs = append(p.pairs, [2][]bool{})
+	}
+	pair := &p.pairs[depth]
+	pair[0] = growGlobState(pair[0], width)
+	pair[1] = growGlobState(pair[1], width)
+	return pair[0], pair[1]
+}
+
+// growGlobState returns buf resized to width, reusing its backing array when
+// it's already large enough.
+func growGlobState(buf []bool, width int) []bool {
+	if cap(buf) < width {
+		return make([]bool, width)
+	}
+	return buf[:width]
 }
 
-func (n node) find(dst []int, prefix string) []int {
-	if strings.HasPrefix(n.prefix, prefix) {
-		// match found
+// findGlob performs a DFS over the trie carrying the current NFA state set,
+// pruning subtrees whose node.prefix cannot advance any state. states is
+// owned by the caller (it's shared read-only with this node's siblings) and
+// is never mutated in place; pool supplies the pair of buffers findGlob
+// ping-pongs between while advancing past n.prefix, indexed by depth (this
+// node's distance from the root) so the whole DFS reuses a small, stable set
+// of buffers instead of allocating one per rune consumed.
+func (n node[V]) findGlob(dst []V, states []bool, prog *globProgram, separator rune, segmented bool, pool *globStatePool, depth int) []V {
+	a, b := pool.buffers(depth, len(states))
+	toggle := 0
+	for _, r := range n.prefix {
+		next := a
+		if toggle == 1 {
+			next = b
+		}
+		for i := range next {
+			next[i] = false
+		}
+		if !stepGlob(next, states, prog, r, separator, segmented) {
+			return dst
+		}
+		states = next
+		toggle = 1 - toggle
+	}
+	if states[len(prog.ops)] {
+		for _, e := range n.entries {
+			dst = append(dst, e.value)
+		}
+	}
+	if n.dense != nil {
+		for _, c := range n.dense.ascii {
+			if c != nil {
+				dst = c.findGlob(dst, states, prog, separator, segmented, pool, depth+1)
+			}
+		}
+		if len(n.dense.extra) != 0 {
+			runes := make([]rune, 0, len(n.dense.extra))
+			for r := range n.dense.extra {
+				runes = append(runes, r)
+			}
+			sort.Slice(runes, func(i, j int) bool { return runes[i] < runes[j] })
+			for _, r := range runes {
+				dst = n.dense.extra[r].findGlob(dst, states, prog, separator, segmented, pool, depth+1)
+			}
+		}
+	} else {
+		for _, c := range n.children {
+			dst = c.findGlob(dst, states, prog, separator, segmented, pool, depth+1)
+		}
+	}
+	return dst
+}
+
+func (n node[V]) find(dst []V, prefix string) []V {
+	commonPrefix := n.commonPrefix(n.prefix, prefix)
+	if len(commonPrefix) == len(prefix) {
+		// prefix is consumed entirely within (or exactly at) n.prefix: match found
 		return n.collectValues(dst)
 	}
+	if len(commonPrefix) < len(n.prefix) {
+		// prefix diverges from n.prefix before either is exhausted: no match
+		return dst
+	}
+	subPrefix := prefix[len(commonPrefix):]
+	firstRune := n.firstRune(subPrefix)
+	if n.dense != nil {
+		c := n.dense.get(firstRune)
+		if c == nil {
+			return dst
+		}
+		return c.find(dst, subPrefix)
+	}
 	// binary search for the child with matching first rune of prefix
 	// adapted and inlined from sort.Search
-	subPrefix := prefix[len(n.prefix):]
-	firstRune := n.firstRune(subPrefix)
 	lo, hi := 0, len(n.children)
 	for lo < hi {
 		mid := lo + (hi-lo)/2
@@ -97,34 +742,339 @@ func (n node) find(dst []int, prefix string) []int {
 	return n.children[lo].find(dst, subPrefix)
 }
 
-func (n node) collectValues(dst []int) []int {
-	dst = append(dst, n.values...)
+// delete returns a new node with origKey's entries removed from the node
+// reached by following remaining, the exact suffix Add would have inserted
+// (unlike find/locate, which match prefix as a leading substring of
+// n.prefix), and any resulting compaction applied. It returns n itself
+// (unchanged) and false if remaining wasn't found, so callers can tell a
+// no-op from a real change. Subtrees it doesn't descend into are shared
+// with n, so n (and anything holding onto it, such as a Snapshot) is
+// unaffected.
+//
+// When an entry is removed, it compacts the child it was removed from or
+// beneath: an emptied child is pruned entirely, and a child holding no
+// entries of its own and left with exactly one grandchild is merged with it,
+// undoing split.
+func (n *node[V]) delete(remaining, origKey string) (*node[V], bool) {
+	commonPrefix := n.commonPrefix(n.prefix, remaining)
+	if len(commonPrefix) != len(n.prefix) {
+		return n, false
+	}
+	clone := *n
+	if len(commonPrefix) == len(remaining) {
+		entries, removed := clone.removeEntries(origKey)
+		if !removed {
+			return n, false
+		}
+		clone.entries = entries
+		return &clone, true
+	}
+	subRemaining := remaining[len(commonPrefix):]
+	firstRune := clone.firstRune(subRemaining)
+	if clone.dense != nil {
+		c := clone.dense.get(firstRune)
+		if c == nil {
+			return n, false
+		}
+		newChild, removed := c.delete(subRemaining, origKey)
+		if !removed {
+			return n, false
+		}
+		dense := &denseChildren[V]{ascii: clone.dense.ascii}
+		if clone.dense.extra != nil {
+			dense.extra = make(map[rune]*node[V], len(clone.dense.extra))
+			for r, c := range clone.dense.extra {
+				dense.extra[r] = c
+			}
+		}
+		if newChild.isEmpty() {
+			dense.delete(firstRune)
+		} else {
+			newChild.mergeSingleChild()
+			dense.set(firstRune, newChild)
+		}
+		clone.dense = dense
+		return &clone, true
+	}
+	// binary search for the child with matching first rune of subRemaining
+	// adapted and inlined from sort.Search
+	lo, hi := 0, len(clone.children)
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		if clone.firstRune(clone.children[mid].prefix) < firstRune {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	if lo >= len(clone.children) || clone.firstRune(clone.children[lo].prefix) != firstRune {
+		return n, false
+	}
+	newChild, removed := clone.children[lo].delete(subRemaining, origKey)
+	if !removed {
+		return n, false
+	}
+	children := append([]node[V](nil), clone.children...)
+	if newChild.isEmpty() {
+		children = append(children[:lo], children[lo+1:]...)
+	} else {
+		newChild.mergeSingleChild()
+		children[lo] = *newChild
+	}
+	clone.children = children
+	return &clone, true
+}
+
+// removeEntries returns a new entries slice with every entry whose original
+// key is key removed, leaving n.entries itself untouched, and reports
+// whether any were removed.
+func (n *node[V]) removeEntries(key string) ([]leaf[V], bool) {
+	removed := false
+	out := make([]leaf[V], 0, len(n.entries))
+	for _, e := range n.entries {
+		if e.key == key {
+			removed = true
+			continue
+		}
+		out = append(out, e)
+	}
+	if len(out) == 0 {
+		out = nil
+	}
+	return out, removed
+}
+
+// isEmpty reports whether n holds no entries and no children.
+func (n *node[V]) isEmpty() bool {
+	if len(n.entries) != 0 {
+		return false
+	}
+	if n.dense != nil {
+		return n.dense.empty()
+	}
+	return len(n.children) == 0
+}
+
+// mergeSingleChild collapses n with its only child, undoing split, as long
+// as n itself holds no entries of its own.
+func (n *node[V]) mergeSingleChild() {
+	if len(n.entries) != 0 {
+		return
+	}
+	only, ok := n.onlyChild()
+	if !ok {
+		return
+	}
+	merged := *only
+	merged.prefix = n.prefix + only.prefix
+	*n = merged
+}
+
+// onlyChild returns n's sole child, if it has exactly one.
+func (n *node[V]) onlyChild() (*node[V], bool) {
+	if n.dense != nil {
+		var only *node[V]
+		count := 0
+		for _, c := range n.dense.ascii {
+			if c != nil {
+				only, count = c, count+1
+			}
+		}
+		for _, c := range n.dense.extra {
+			only, count = c, count+1
+		}
+		return only, count == 1
+	}
+	if len(n.children) == 1 {
+		return &n.children[0], true
+	}
+	return nil, false
+}
+
+// locate returns the node Find/Walk would match prefix against, i.e. the
+// node n whose prefix chain from the root has prefix as one of its leading
+// substrings.
+func (n node[V]) locate(prefix string) (node[V], bool) {
+	commonPrefix := n.commonPrefix(n.prefix, prefix)
+	if len(commonPrefix) == len(prefix) {
+		return n, true
+	}
+	if len(commonPrefix) < len(n.prefix) {
+		return node[V]{}, false
+	}
+	subPrefix := prefix[len(commonPrefix):]
+	firstRune := n.firstRune(subPrefix)
+	if n.dense != nil {
+		c := n.dense.get(firstRune)
+		if c == nil {
+			return node[V]{}, false
+		}
+		return c.locate(subPrefix)
+	}
+	lo, hi := 0, len(n.children)
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		if n.firstRune(n.children[mid].prefix) < firstRune {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	if lo >= len(n.children) || n.firstRune(n.children[lo].prefix) != firstRune {
+		return node[V]{}, false
+	}
+	return n.children[lo].locate(subPrefix)
+}
+
+// visitHeadValues calls visit for every head-tagged entry (see leaf.head) in
+// n's subtree, stopping at the first error.
+func (n node[V]) visitHeadValues(visit func(value V) error) error {
+	for _, e := range n.entries {
+		if !e.head {
+			continue
+		}
+		if err := visit(e.value); err != nil {
+			return err
+		}
+	}
+	if n.dense != nil {
+		for _, c := range n.dense.ascii {
+			if c == nil {
+				continue
+			}
+			if err := c.visitHeadValues(visit); err != nil {
+				return err
+			}
+		}
+		if len(n.dense.extra) == 0 {
+			return nil
+		}
+		runes := make([]rune, 0, len(n.dense.extra))
+		for r := range n.dense.extra {
+			runes = append(runes, r)
+		}
+		sort.Slice(runes, func(i, j int) bool { return runes[i] < runes[j] })
+		for _, r := range runes {
+			if err := n.dense.extra[r].visitHeadValues(visit); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, c := range n.children {
+		if err := c.visitHeadValues(visit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (n node[V]) walk(keyPrefix, prefix string, visit func(key string, value V) error) error {
+	commonPrefix := n.commonPrefix(n.prefix, prefix)
+	if len(commonPrefix) == len(prefix) {
+		return n.visitSubtree(keyPrefix+n.prefix, visit)
+	}
+	if len(commonPrefix) < len(n.prefix) {
+		return nil
+	}
+	subPrefix := prefix[len(commonPrefix):]
+	firstRune := n.firstRune(subPrefix)
+	if n.dense != nil {
+		c := n.dense.get(firstRune)
+		if c == nil {
+			return nil
+		}
+		return c.walk(keyPrefix+n.prefix, subPrefix, visit)
+	}
+	lo, hi := 0, len(n.children)
+	for lo < hi {
+		mid := lo + (hi-lo)/2
+		if n.firstRune(n.children[mid].prefix) < firstRune {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	if lo >= len(n.children) || n.firstRune(n.children[lo].prefix) != firstRune {
+		return nil
+	}
+	return n.children[lo].walk(keyPrefix+n.prefix, subPrefix, visit)
+}
+
+// visitSubtree calls visit for every value in n's subtree, with key as the
+// already-concatenated path from the root down to n. A SkipSubtree from
+// visit is absorbed here (skipping n's children while letting siblings of n
+// continue to be visited by the caller); any other error, including
+// StopWalk, propagates up unchanged.
+func (n node[V]) visitSubtree(key string, visit func(key string, value V) error) error {
+	for _, e := range n.entries {
+		if err := visit(key, e.value); err != nil {
+			if err == SkipSubtree {
+				return nil
+			}
+			return err
+		}
+	}
+	if n.dense != nil {
+		for _, c := range n.dense.ascii {
+			if c == nil {
+				continue
+			}
+			if err := c.visitSubtree(key+c.prefix, visit); err != nil {
+				return err
+			}
+		}
+		if len(n.dense.extra) == 0 {
+			return nil
+		}
+		runes := make([]rune, 0, len(n.dense.extra))
+		for r := range n.dense.extra {
+			runes = append(runes, r)
+		}
+		sort.Slice(runes, func(i, j int) bool { return runes[i] < runes[j] })
+		for _, r := range runes {
+			if err := n.dense.extra[r].visitSubtree(key+n.dense.extra[r].prefix, visit); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for _, c := range n.children {
+		if err := c.visitSubtree(key+c.prefix, visit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (n node[V]) collectValues(dst []V) []V {
+	for _, e := range n.entries {
+		dst = append(dst, e.value)
+	}
+	if n.dense != nil {
+		return n.dense.collectValues(dst)
+	}
 	for _, c := range n.children {
 		dst = c.collectValues(dst)
 	}
 	return dst
 }
 
-func (n *node) split(commonPrefix string) {
-	*n = node{
+func (n *node[V]) split(commonPrefix string) {
+	*n = node[V]{
 		prefix: commonPrefix,
-		children: []node{
+		children: []node[V]{
 			{
 				prefix:   n.prefix[len(commonPrefix):],
-				values:   n.values,
+				entries:  n.entries,
 				children: n.children,
+				dense:    n.dense,
 			},
 		},
 	}
 }
 
-func (n *node) insertChildAtIndex(c node, i int) {
-	n.children = append(n.children, n.children[len(n.children)-1])
-	copy(n.children[i+1:], n.children[i:len(n.children)-1])
-	n.children[i] = c
-}
-
-func (*node) firstRune(str string) rune {
+func (*node[V]) firstRune(str string) rune {
 	r, _ := utf8.DecodeRuneInString(str)
 	return r
 }
@@ -132,7 +1082,7 @@ func (*node) firstRune(str string) rune {
 // commonPrefix returns the the prefix that the two strings have in common.
 //
 // valid UTF-8 strings are assumed.
-func (*node) commonPrefix(a, b string) string {
+func (*node[V]) commonPrefix(a, b string) string {
 	i, commonLen := 0, len(a)
 	if len(b) < commonLen {
 		commonLen = len(b)
@@ -1,8 +1,11 @@
 package prefixtrie_test
 
 import (
+	"errors"
 	"fmt"
 	"math/rand"
+	"regexp"
+	"sort"
 	"strings"
 	"testing"
 	"unicode/utf8"
@@ -12,7 +15,7 @@ import (
 )
 
 func Test(t *testing.T) {
-	var trie prefixtrie.Trie
+	var trie prefixtrie.Trie[int]
 	rand.Seed(1)
 	keys := make([]string, 0, 1000)
 	for cap(keys) > len(keys) {
@@ -98,17 +101,385 @@ func Test(t *testing.T) {
 	})
 
 	t.Run("partial match", func(t *testing.T) {
-		var trie prefixtrie.Trie
+		var trie prefixtrie.Trie[int]
 		trie.Add("1234567", 1)
 		results := trie.Find(nil, "1245")
 		if len(results) != 0 {
 			t.Fatalf("expected len() %d, got %d", 0, len(results))
 		}
 	})
+
+	t.Run("walk", func(t *testing.T) {
+		t.Run("visits the same values as Find", func(t *testing.T) {
+			for i, key := range keys {
+				var walked []int
+				if err := trie.Walk(key, func(_ string, value int) error {
+					walked = append(walked, value)
+					return nil
+				}); err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if found := trie.Find(nil, key); !equalSets(walked, found) {
+					t.Fatalf("at index %d: walked %#v, find %#v", i, walked, found)
+				}
+			}
+		})
+
+		t.Run("keys match the prefix that produced each value", func(t *testing.T) {
+			var trie prefixtrie.Trie[int]
+			trie.Add("www.google.com", 0)
+			trie.Add("www.foogle.net", 1)
+			wantKeys := map[int]string{0: "www.google.com", 1: "www.foogle.net"}
+			if err := trie.Walk("www", func(key string, value int) error {
+				if key != wantKeys[value] {
+					t.Fatalf("value %d: expected key %q, got %q", value, wantKeys[value], key)
+				}
+				return nil
+			}); err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+
+		t.Run("SkipSubtree skips only the current key's values", func(t *testing.T) {
+			var trie prefixtrie.Trie[int]
+			trie.Add("www.google.com", 0)
+			trie.Add("www.foogle.net", 1)
+			var visited []int
+			err := trie.Walk("www", func(key string, value int) error {
+				visited = append(visited, value)
+				if key == "www.foogle.net" {
+					return prefixtrie.SkipSubtree
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !equalSets(visited, []int{0, 1}) {
+				t.Fatalf("expected both values to be visited, got %#v", visited)
+			}
+		})
+
+		t.Run("StopWalk halts without error", func(t *testing.T) {
+			var trie prefixtrie.Trie[int]
+			trie.Add("www.google.com", 0)
+			trie.Add("www.foogle.net", 1)
+			calls := 0
+			err := trie.Walk("www", func(string, int) error {
+				calls++
+				return prefixtrie.StopWalk
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if calls != 1 {
+				t.Fatalf("expected exactly 1 call, got %d", calls)
+			}
+		})
+
+		t.Run("other errors propagate", func(t *testing.T) {
+			var trie prefixtrie.Trie[int]
+			trie.Add("www.google.com", 0)
+			wantErr := errors.New("boom")
+			err := trie.Walk("www", func(string, int) error {
+				return wantErr
+			})
+			if err != wantErr {
+				t.Fatalf("expected %v, got %v", wantErr, err)
+			}
+		})
+
+		t.Run("partial match", func(t *testing.T) {
+			var trie prefixtrie.Trie[int]
+			trie.Add("1234567", 1)
+			visited := 0
+			err := trie.Walk("1245", func(string, int) error {
+				visited++
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if visited != 0 {
+				t.Fatalf("expected 0 visits, got %d", visited)
+			}
+		})
+	})
+
+	t.Run("lookup", func(t *testing.T) {
+		t.Run("unique prefix resolves to the key's value", func(t *testing.T) {
+			var trie prefixtrie.Trie[string]
+			trie.Add("deadbeef01", "container A")
+			trie.Add("cafef00d02", "container B")
+			value, err := trie.Lookup("dead")
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if value != "container A" {
+				t.Fatalf("expected %q, got %q", "container A", value)
+			}
+		})
+
+		t.Run("mid-string substring match is not a prefix match", func(t *testing.T) {
+			var trie prefixtrie.Trie[string]
+			trie.Add("deadbeef01", "container A")
+			_, err := trie.Lookup("beef")
+			if err != prefixtrie.ErrPrefixNotFound {
+				t.Fatalf("expected %v, got %v", prefixtrie.ErrPrefixNotFound, err)
+			}
+		})
+
+		t.Run("unknown prefix", func(t *testing.T) {
+			var trie prefixtrie.Trie[string]
+			trie.Add("deadbeef01", "container A")
+			_, err := trie.Lookup("zzz")
+			if err != prefixtrie.ErrPrefixNotFound {
+				t.Fatalf("expected %v, got %v", prefixtrie.ErrPrefixNotFound, err)
+			}
+		})
+
+		t.Run("ambiguous prefix", func(t *testing.T) {
+			var trie prefixtrie.Trie[string]
+			trie.Add("deadbeef01", "container A")
+			trie.Add("deadf00d02", "container B")
+			_, err := trie.Lookup("dead")
+			want := prefixtrie.ErrAmbiguousPrefix{Prefix: "dead"}
+			if err != want {
+				t.Fatalf("expected %v, got %v", want, err)
+			}
+		})
+
+		t.Run("partial match", func(t *testing.T) {
+			var trie prefixtrie.Trie[int]
+			trie.Add("1234567", 1)
+			_, err := trie.Lookup("1245")
+			if err != prefixtrie.ErrPrefixNotFound {
+				t.Fatalf("expected %v, got %v", prefixtrie.ErrPrefixNotFound, err)
+			}
+		})
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		t.Run("matches a from-scratch build of the surviving keys", func(t *testing.T) {
+			var trie prefixtrie.Trie[int]
+			localKeys := keys[:200]
+			for i, k := range localKeys {
+				trie.Add(k, i)
+			}
+
+			toDelete := localKeys[:100]
+			for _, k := range toDelete {
+				if !trie.Delete(k) {
+					t.Fatalf("expected Delete(%q) to report true", k)
+				}
+			}
+			for _, k := range toDelete {
+				if trie.Delete(k) {
+					t.Fatalf("expected Delete(%q) to report false on second call", k)
+				}
+			}
+
+			var want prefixtrie.Trie[int]
+			survivors := localKeys[100:]
+			for i, k := range survivors {
+				want.Add(k, 100+i)
+			}
+
+			for _, k := range localKeys {
+				got, expected := trie.Find(nil, k), want.Find(nil, k)
+				if !equalSets(got, expected) {
+					t.Fatalf("key %q: got %#v, want %#v", k, got, expected)
+				}
+			}
+		})
+
+		t.Run("unknown key", func(t *testing.T) {
+			var trie prefixtrie.Trie[int]
+			trie.Add("abc", 1)
+			if trie.Delete("xyz") {
+				t.Fatal("expected Delete of an absent key to report false")
+			}
+		})
+
+		t.Run("does not affect a different key sharing a suffix", func(t *testing.T) {
+			var trie prefixtrie.Trie[int]
+			trie.Add("abc", 1)
+			trie.Add("xabc", 2)
+			trie.Delete("abc")
+			if results := trie.Find(nil, "abc"); !equalSets(results, []int{2}) {
+				t.Fatalf("expected [2], got %#v", results)
+			}
+		})
+	})
+
+	t.Run("findglob", func(t *testing.T) {
+		t.Run("? matches exactly one rune", func(t *testing.T) {
+			var trie prefixtrie.Trie[int]
+			trie.Add("cat", 0)
+			trie.Add("car", 1)
+			trie.Add("cart", 2)
+			if results := trie.FindGlob(nil, "ca?"); !equalSets(results, []int{0, 1}) {
+				t.Fatalf("expected [0 1], got %#v", results)
+			}
+		})
+
+		t.Run("* matches a run of runes within a segment", func(t *testing.T) {
+			var trie prefixtrie.Trie[int]
+			trie.GlobSeparator = '.'
+			trie.Add("www.google.com", 0)
+			trie.Add("www.foogle.net", 1)
+			if results := trie.FindGlob(nil, "www.*.com"); !equalSets(results, []int{0}) {
+				t.Fatalf("expected [0], got %#v", results)
+			}
+			// "www.*" alone can't match the full key: the segment-bounded '*'
+			// can't cross the separator before "com"/"net".
+			if results := trie.FindGlob(nil, "www.*"); len(results) != 0 {
+				t.Fatalf("expected no match, got %#v", results)
+			}
+		})
+
+		t.Run("* does not cross a segment separator", func(t *testing.T) {
+			var trie prefixtrie.Trie[int]
+			trie.GlobSeparator = '.'
+			trie.Add("www.google.com", 0)
+			if results := trie.FindGlob(nil, "www*com"); len(results) != 0 {
+				t.Fatalf("expected no match, got %#v", results)
+			}
+		})
+
+		t.Run("** matches a run of runes across segments", func(t *testing.T) {
+			var trie prefixtrie.Trie[int]
+			trie.GlobSeparator = '.'
+			trie.Add("www.google.com", 0)
+			if results := trie.FindGlob(nil, "www**com"); !equalSets(results, []int{0}) {
+				t.Fatalf("expected [0], got %#v", results)
+			}
+		})
+
+		t.Run("without a GlobSeparator, * behaves like **", func(t *testing.T) {
+			var trie prefixtrie.Trie[int]
+			trie.Add("www.google.com", 0)
+			if results := trie.FindGlob(nil, "www*com"); !equalSets(results, []int{0}) {
+				t.Fatalf("expected [0], got %#v", results)
+			}
+		})
+
+		t.Run("matches the full indexed suffix, like a substring match bounded by wildcards", func(t *testing.T) {
+			var trie prefixtrie.Trie[int]
+			trie.Add("www.google.com", 0)
+			if results := trie.FindGlob(nil, "goo?le*"); !equalSets(results, []int{0}) {
+				t.Fatalf("expected [0], got %#v", results)
+			}
+			if results := trie.FindGlob(nil, "goo?le"); len(results) != 0 {
+				t.Fatalf("expected no match without a trailing wildcard, got %#v", results)
+			}
+		})
+
+		t.Run("not found", func(t *testing.T) {
+			var trie prefixtrie.Trie[int]
+			trie.Add("www.google.com", 0)
+			if results := trie.FindGlob(nil, "yah?o"); len(results) != 0 {
+				t.Fatalf("expected no match, got %#v", results)
+			}
+		})
+	})
+
+	t.Run("txn", func(t *testing.T) {
+		t.Run("uncommitted writes are invisible to the Trie", func(t *testing.T) {
+			var trie prefixtrie.Trie[int]
+			trie.Add("abc", 1)
+			txn := trie.Txn()
+			txn.Add("abd", 2)
+			if results := trie.Find(nil, "abd"); len(results) != 0 {
+				t.Fatalf("expected no match before Commit, got %#v", results)
+			}
+			txn.Commit()
+			if results := trie.Find(nil, "abd"); !equalSets(results, []int{2}) {
+				t.Fatalf("expected [2] after Commit, got %#v", results)
+			}
+		})
+
+		t.Run("a Snapshot keeps seeing the tree as of when it was taken", func(t *testing.T) {
+			var trie prefixtrie.Trie[int]
+			trie.Add("abc", 1)
+			snapshot := trie.Snapshot()
+
+			txn := trie.Txn()
+			txn.Add("abd", 2)
+			txn.Delete("abc")
+			txn.Commit()
+
+			if results := snapshot.Find(nil, "ab"); !equalSets(results, []int{1}) {
+				t.Fatalf("expected the old snapshot to still see [1], got %#v", results)
+			}
+			if results := trie.Find(nil, "ab"); !equalSets(results, []int{2}) {
+				t.Fatalf("expected the committed trie to see [2], got %#v", results)
+			}
+		})
+
+		t.Run("a Snapshot keeps seeing the tree even across direct Add/Delete calls on the Trie", func(t *testing.T) {
+			var trie prefixtrie.Trie[int]
+			trie.Add("abc", 1)
+			snapshot := trie.Snapshot()
+
+			trie.Add("abd", 2)
+			trie.Delete("abc")
+
+			if results := snapshot.Find(nil, "ab"); !equalSets(results, []int{1}) {
+				t.Fatalf("expected the old snapshot to still see [1], got %#v", results)
+			}
+			if results := trie.Find(nil, "ab"); !equalSets(results, []int{2}) {
+				t.Fatalf("expected the trie to see [2], got %#v", results)
+			}
+		})
+
+		t.Run("a later direct Add/Delete on the Trie does not leak into an open Txn", func(t *testing.T) {
+			var trie prefixtrie.Trie[int]
+			trie.Add("abc", 1)
+			txn := trie.Txn()
+
+			trie.Add("abd", 2)
+			trie.Delete("abc")
+
+			if results := txn.Snapshot().Find(nil, "ab"); !equalSets(results, []int{1}) {
+				t.Fatalf("expected the txn to still see only [1], got %#v", results)
+			}
+		})
+
+		t.Run("matches a from-scratch build of the same writes", func(t *testing.T) {
+			var trie prefixtrie.Trie[int]
+			localKeys := keys[:200]
+			for i, k := range localKeys {
+				trie.Add(k, i)
+			}
+
+			var want prefixtrie.Trie[int]
+			txn := trie.Txn()
+			toDelete := localKeys[:100]
+			for _, k := range toDelete {
+				if !txn.Delete(k) {
+					t.Fatalf("expected Txn.Delete(%q) to report true", k)
+				}
+			}
+			txn.Commit()
+
+			survivors := localKeys[100:]
+			for i, k := range survivors {
+				want.Add(k, 100+i)
+			}
+
+			for _, k := range localKeys {
+				got, expected := trie.Find(nil, k), want.Find(nil, k)
+				if !equalSets(got, expected) {
+					t.Fatalf("key %q: got %#v, want %#v", k, got, expected)
+				}
+			}
+		})
+	})
 }
 
 func Example() {
-	var trie prefixtrie.Trie
+	var trie prefixtrie.Trie[int]
 	trie.Add("www.google.com", 0)
 	trie.Add("www.foogle.net", 1)
 	fmt.Println(
@@ -122,8 +493,70 @@ func Example() {
 	// Output: [0] [1] [1 0] [0 1] [1] [0]
 }
 
+func ExampleIntTrie() {
+	// IntTrie is an alias for Trie[int], the int-valued trie the package
+	// provided before it was made generic.
+	var trie prefixtrie.IntTrie
+	trie.Add("www.google.com", 0)
+	trie.Add("www.foogle.net", 1)
+	fmt.Println(trie.Find(nil, "www"))
+	// Output: [1 0]
+}
+
+func ExampleTrie_Walk() {
+	var trie prefixtrie.Trie[int]
+	trie.Add("www.google.com", 0)
+	trie.Add("www.foogle.net", 1)
+	trie.Walk("www", func(key string, value int) error {
+		fmt.Println(key, value)
+		return nil
+	})
+	// Output:
+	// www.foogle.net 1
+	// www.google.com 0
+}
+
+func ExampleTrie_Lookup() {
+	var trie prefixtrie.Trie[string]
+	trie.Add("dae5041bcc", "a")
+	trie.Add("cafef00d02", "b")
+	value, err := trie.Lookup("dae5")
+	fmt.Println(value, err)
+	_, err = trie.Lookup("zz")
+	fmt.Println(err)
+	// Output:
+	// a <nil>
+	// prefixtrie: prefix not found
+}
+
+func ExampleTrie_FindGlob() {
+	var trie prefixtrie.Trie[int]
+	trie.GlobSeparator = '.'
+	trie.Add("www.google.com", 0)
+	trie.Add("www.foogle.net", 1)
+	fmt.Println(
+		trie.FindGlob(nil, "www.*.com"),
+		trie.FindGlob(nil, "www.?oogle.net"),
+		trie.FindGlob(nil, "www**com"),
+	)
+	// Output: [0] [1] [0]
+}
+
+func ExampleTrie_Txn() {
+	var trie prefixtrie.Trie[int]
+	trie.Add("www.google.com", 0)
+	snapshot := trie.Snapshot()
+
+	txn := trie.Txn()
+	txn.Add("www.foogle.net", 1)
+	txn.Commit()
+
+	fmt.Println(snapshot.Find(nil, "www"), trie.Find(nil, "www"))
+	// Output: [0] [1 0]
+}
+
 func Benchmark(b *testing.B) {
-	var trie prefixtrie.Trie
+	var trie prefixtrie.Trie[int]
 	rand.Seed(1)
 	words := make([]string, 0, 1000)
 	for cap(words) > len(words) {
@@ -180,6 +613,76 @@ func Benchmark(b *testing.B) {
 	})
 }
 
+// BenchmarkWideFanout exercises nodes whose children exceed
+// prefixtrie.MaxChildrenPerSparseNode, i.e. the dense child representation,
+// by spreading the keys' first bytes across the 94 printable ASCII
+// characters.
+func BenchmarkWideFanout(b *testing.B) {
+	var trie prefixtrie.Trie[int]
+	rand.Seed(1)
+	const n = 4000
+	keys := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		first := byte(33 + i%94) // cycle through the printable ASCII range
+		keys = append(keys, string(first)+randomHex())
+	}
+	for i, key := range keys {
+		trie.Add(key, i)
+	}
+
+	b.Run("prefix trie", func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			_ = trie.Find(nil, keys[n%len(keys)])
+		}
+	})
+
+	b.Run("prefix trie with cached results", func(b *testing.B) {
+		b.ReportAllocs()
+		v := []int(nil)
+		for n := 0; n < b.N; n++ {
+			v = trie.Find(v[:0], keys[n%len(keys)])
+		}
+	})
+}
+
+// BenchmarkFindGlob compares FindGlob against the alternative of filtering
+// Find's substring matches through a compiled regexp.
+func BenchmarkFindGlob(b *testing.B) {
+	var trie prefixtrie.Trie[int]
+	trie.GlobSeparator = '.'
+	rand.Seed(1)
+	words := make([]string, 0, 1000)
+	for cap(words) > len(words) {
+		words = append(words, "www."+randomHex()+".com")
+	}
+	for i, word := range words {
+		trie.Add(word, i)
+	}
+
+	b.Run("FindGlob", func(b *testing.B) {
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			_ = trie.FindGlob(nil, "www.*.com")
+		}
+	})
+
+	b.Run("Find filtered by regexp", func(b *testing.B) {
+		re := regexp.MustCompile(`^www\.[^.]*\.com$`)
+		b.ReportAllocs()
+		var all []int
+		for n := 0; n < b.N; n++ {
+			all = trie.Find(all[:0], "www.")
+			matched := all[:0:0]
+			for _, v := range all {
+				if re.MatchString(words[v]) {
+					matched = append(matched, v)
+				}
+			}
+		}
+	})
+}
+
 func randomHex() string {
 	buf := make([]byte, 24)
 	raw := buf[len(buf)/2:]
@@ -195,6 +698,21 @@ func randomHex() string {
 	return *(*string)(unsafe.Pointer(&buf)) // nolint: gosec
 }
 
+func equalSets(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a, b = append([]int(nil), a...), append([]int(nil), b...)
+	sort.Ints(a)
+	sort.Ints(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
 func reverse(str string) string {
 	buf := make([]byte, len(str))
 	for i, r := range str {